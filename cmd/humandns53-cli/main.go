@@ -0,0 +1,243 @@
+// humandns53-cli writes records directly into the structured Redis zone
+// schema used by humandns53 (see package zone), without going through an
+// RFC 2136 dynamic update.
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/go-redis/redis"
+	"github.com/miekg/dns"
+
+	"github.com/h4sh5/humandns53/internal/zone"
+)
+
+func usage() {
+	fmt.Fprintln(os.Stderr, `usage: humandns53-cli add <TYPE> <name> <data...> [--ttl seconds]
+
+example: humandns53-cli add A foo.example 1.2.3.4 --ttl 300
+
+types and their <data...>:
+  A     <ip>
+  AAAA  <ip>
+  CNAME <target>
+  NS    <ns>
+  PTR   <target>
+  MX    <priority> <target>
+  SRV   <priority> <weight> <port> <target>
+  TXT   <chunk> [chunk...]
+  SOA   <ns> <mbox> <serial> <refresh> <retry> <expire> <minttl>`)
+	os.Exit(2)
+}
+
+func main() {
+	redisAddr := flag.String("redis-addr", "localhost:6379", "address of the redis server backing the zone")
+	ttl := flag.Uint("ttl", 1800, "TTL in seconds for the new record")
+
+	// --ttl and --redis-addr are accepted anywhere on the command line,
+	// not just before the positional arguments, so pull them out before
+	// handing the rest to flag.Parse.
+	var flagArgs, positional []string
+	args := os.Args[1:]
+	for i := 0; i < len(args); i++ {
+		switch args[i] {
+		case "--ttl", "-ttl", "--redis-addr", "-redis-addr":
+			flagArgs = append(flagArgs, args[i])
+			if i+1 < len(args) {
+				i++
+				flagArgs = append(flagArgs, args[i])
+			}
+		default:
+			positional = append(positional, args[i])
+		}
+	}
+
+	if err := flag.CommandLine.Parse(flagArgs); err != nil {
+		os.Exit(2)
+	}
+
+	if len(positional) < 4 || positional[0] != "add" {
+		usage()
+	}
+
+	rrTypeName := strings.ToUpper(positional[1])
+	name := dns.Fqdn(positional[2])
+	data := positional[3:]
+
+	rrType, ok := dns.StringToType[rrTypeName]
+	if !ok || !zone.SupportedTypes[rrType] {
+		fmt.Fprintf(os.Stderr, "unsupported record type %q\n", positional[1])
+		os.Exit(2)
+	}
+
+	record, ip, err := recordFor(rrType, data, uint32(*ttl))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err.Error())
+		os.Exit(1)
+	}
+
+	redisClient := redis.NewClient(&redis.Options{Addr: *redisAddr})
+	defer redisClient.Close()
+
+	key := zone.Key(name, rrTypeName)
+
+	updated, err := zone.AppendRecord(redisClient.Get(key).Val(), record)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err.Error())
+		os.Exit(1)
+	}
+
+	if err := redisClient.Set(key, updated, 0).Err(); err != nil {
+		fmt.Fprintln(os.Stderr, "error writing to redis:", err.Error())
+		os.Exit(1)
+	}
+
+	if rrType == dns.TypeA {
+		if err := provisionPTR(redisClient, ip, name, uint32(*ttl)); err != nil {
+			fmt.Fprintln(os.Stderr, "warning: failed to provision PTR record:", err.Error())
+		}
+	}
+
+	fmt.Printf("added %s %s %s\n", rrTypeName, name, strings.Join(data, " "))
+}
+
+// recordFor parses data (the positional arguments following <name>) into
+// the record shape zone.AppendRecord expects for rrType. It also returns
+// the parsed IP for TypeA, so the caller can provision the matching PTR
+// record without reparsing it.
+func recordFor(rrType uint16, data []string, ttl uint32) (record interface{}, ip net.IP, err error) {
+	switch rrType {
+	case dns.TypeA, dns.TypeAAAA:
+		if len(data) != 1 {
+			return nil, nil, fmt.Errorf("%s takes exactly one <ip>", dns.TypeToString[rrType])
+		}
+		ip = net.ParseIP(data[0])
+		if ip == nil {
+			return nil, nil, fmt.Errorf("invalid IP address %q", data[0])
+		}
+		return zone.ARecord{IP: data[0], TTL: ttl}, ip, nil
+
+	case dns.TypeCNAME:
+		if len(data) != 1 {
+			return nil, nil, fmt.Errorf("CNAME takes exactly one <target>")
+		}
+		return zone.CNAMERecord{Target: dns.Fqdn(data[0]), TTL: ttl}, nil, nil
+
+	case dns.TypeNS:
+		if len(data) != 1 {
+			return nil, nil, fmt.Errorf("NS takes exactly one <ns>")
+		}
+		return zone.NSRecord{NS: dns.Fqdn(data[0]), TTL: ttl}, nil, nil
+
+	case dns.TypePTR:
+		if len(data) != 1 {
+			return nil, nil, fmt.Errorf("PTR takes exactly one <target>")
+		}
+		return zone.PTRRecord{Target: dns.Fqdn(data[0]), TTL: ttl}, nil, nil
+
+	case dns.TypeMX:
+		if len(data) != 2 {
+			return nil, nil, fmt.Errorf("MX takes exactly <priority> <target>")
+		}
+		priority, err := parseUint16(data[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		return zone.MXRecord{Priority: priority, Target: dns.Fqdn(data[1]), TTL: ttl}, nil, nil
+
+	case dns.TypeSRV:
+		if len(data) != 4 {
+			return nil, nil, fmt.Errorf("SRV takes exactly <priority> <weight> <port> <target>")
+		}
+		priority, err := parseUint16(data[0])
+		if err != nil {
+			return nil, nil, err
+		}
+		weight, err := parseUint16(data[1])
+		if err != nil {
+			return nil, nil, err
+		}
+		port, err := parseUint16(data[2])
+		if err != nil {
+			return nil, nil, err
+		}
+		return zone.SRVRecord{Priority: priority, Weight: weight, Port: port, Target: dns.Fqdn(data[3]), TTL: ttl}, nil, nil
+
+	case dns.TypeTXT:
+		if len(data) == 0 {
+			return nil, nil, fmt.Errorf("TXT takes at least one <chunk>")
+		}
+		return zone.TXTRecord{Chunks: data, TTL: ttl}, nil, nil
+
+	case dns.TypeSOA:
+		if len(data) != 7 {
+			return nil, nil, fmt.Errorf("SOA takes exactly <ns> <mbox> <serial> <refresh> <retry> <expire> <minttl>")
+		}
+		serial, err := parseUint32(data[2])
+		if err != nil {
+			return nil, nil, err
+		}
+		refresh, err := parseUint32(data[3])
+		if err != nil {
+			return nil, nil, err
+		}
+		retry, err := parseUint32(data[4])
+		if err != nil {
+			return nil, nil, err
+		}
+		expire, err := parseUint32(data[5])
+		if err != nil {
+			return nil, nil, err
+		}
+		minttl, err := parseUint32(data[6])
+		if err != nil {
+			return nil, nil, err
+		}
+		return zone.SOARecord{
+			NS: dns.Fqdn(data[0]), Mbox: dns.Fqdn(data[1]), Serial: serial,
+			Refresh: refresh, Retry: retry, Expire: expire, Minttl: minttl, TTL: ttl,
+		}, nil, nil
+	}
+
+	return nil, nil, fmt.Errorf("unsupported record type %s", dns.TypeToString[rrType])
+}
+
+func parseUint16(s string) (uint16, error) {
+	n, err := strconv.ParseUint(s, 10, 16)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return uint16(n), nil
+}
+
+func parseUint32(s string) (uint32, error) {
+	n, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, fmt.Errorf("invalid number %q", s)
+	}
+	return uint32(n), nil
+}
+
+// provisionPTR adds a PTR record resolving ip's in-addr.arpa owner name
+// back to target, mirroring what the server itself does when an A record
+// is added through a dynamic update.
+func provisionPTR(redisClient *redis.Client, ip net.IP, target string, ttl uint32) error {
+	arpaName, err := zone.PTRZoneName(ip)
+	if err != nil {
+		return err
+	}
+
+	key := zone.Key(arpaName, "PTR")
+
+	updated, err := zone.AppendRecord(redisClient.Get(key).Val(), zone.PTRRecord{Target: target, TTL: ttl})
+	if err != nil {
+		return err
+	}
+
+	return redisClient.Set(key, updated, 0).Err()
+}
@@ -33,293 +33,1171 @@ package main
 */
 
 import (
-	"bytes"
+	"bufio"
+	"container/list"
+	"crypto/tls"
+	"encoding/base64"
 	"encoding/binary"
-	// "fmt"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
 	"log"
 	"net"
+	"net/http"
 	"os"
-	"flag"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
+
 	"github.com/go-redis/redis"
+	"github.com/miekg/dns"
+
+	"github.com/h4sh5/humandns53/internal/zone"
 )
 
-var redisClient *redis.Client 
+var redisClient *redis.Client
 var ExpiryTimeInSeconds uint
 
-// DNSHeader describes the request/response DNS header
-type DNSHeader struct {
-	TransactionID  uint16
-	Flags          uint16
-	NumQuestions   uint16
-	NumAnswers     uint16
-	NumAuthorities uint16
-	NumAdditionals uint16
-}
+// tsigKeys maps a TSIG key name (fully qualified, as it appears on the
+// wire) to its base64-encoded HMAC secret, loaded from -tsig-keyfile.
+var tsigKeys = map[string]string{}
 
-// DNSResourceRecord describes individual records in the request and response of the DNS payload body
-type DNSResourceRecord struct {
-	DomainName         string
-	Type               uint16
-	Class              uint16
-	TimeToLive         uint32
-	ResourceDataLength uint16
-	ResourceData       []byte
-}
+// updateZones is the set of fully-qualified zone names this server is
+// authoritative for and will accept RFC 2136 dynamic updates against.
+var updateZones = map[string]bool{}
 
-// Type and Class values for DNSResourceRecord
 const (
-	TypeA                  uint16 = 1 // a host address
-	TypeAAAA			   uint16 = 28 // ipv6 addr
-	ClassINET              uint16 = 1 // the Internet
-	FlagResponse           uint16 = 1 << 15
-	UDPMaxMessageSizeBytes uint   = 512 // RFC1035
+	defaultUDPPayloadSize = dns.MinMsgSize // 512, RFC1035 no-EDNS0 default
+	maxUDPPayloadSize     = 4096           // RFC6891 §6.2.5, what we accept from and advertise to clients
 )
 
-// Look up values in a database
-func dbLookup(queryResourceRecord DNSResourceRecord) ([]DNSResourceRecord, []DNSResourceRecord, []DNSResourceRecord) {
-	var answerResourceRecords = make([]DNSResourceRecord, 0)
-	var authorityResourceRecords = make([]DNSResourceRecord, 0)
-	var additionalResourceRecords = make([]DNSResourceRecord, 0)
+// redisGet wraps redisClient.Get, counting genuine Redis errors (a plain
+// cache/key miss is not one) against redis_errors_total. The returned error
+// is non-nil only for a genuine Redis error, never for a cache/key miss, so
+// callers can tell "this name truly has no such record" apart from "we
+// couldn't ask Redis" and answer SERVFAIL instead of NXDOMAIN/NODATA.
+func redisGet(key string) (string, error) {
+	result := redisClient.Get(key)
+	if err := result.Err(); err != nil {
+		if err == redis.Nil {
+			return "", nil
+		}
+		redisErrorsTotal.Inc()
+		log.Println("Redis GET error: ", err.Error())
+		return "", err
+	}
+
+	return result.Val(), nil
+}
+
+// redisSet wraps redisClient.Set, counting errors against redis_errors_total.
+func redisSet(key, value string, expiration time.Duration) {
+	if err := redisClient.Set(key, value, expiration).Err(); err != nil {
+		redisErrorsTotal.Inc()
+		log.Println("Redis SET error: ", err.Error())
+	}
+}
+
+// redisDel wraps redisClient.Del, counting errors against redis_errors_total.
+func redisDel(key string) {
+	if err := redisClient.Del(key).Err(); err != nil {
+		redisErrorsTotal.Inc()
+		log.Println("Redis DEL error: ", err.Error())
+	}
+}
+
+// redisExists wraps redisClient.Exists, counting errors against
+// redis_errors_total and reporting false on error.
+func redisExists(key string) bool {
+	result := redisClient.Exists(key)
+	if err := result.Err(); err != nil {
+		redisErrorsTotal.Inc()
+		log.Println("Redis EXISTS error: ", err.Error())
+		return false
+	}
+
+	return result.Val() == 1
+}
+
+// nameHasRecords reports whether any RRset of a supported type is stored
+// for name, i.e. whether the Redis-backed zone owns this name at all. Every
+// supported type's key is checked in a single pipelined round trip rather
+// than one EXISTS per type, since this runs on every cache-miss question
+// that isn't ours, including all traffic destined for the forwarder. The
+// returned error is non-nil only for a genuine Redis error, never for the
+// name simply not being in the zone, so a Redis outage can be told apart
+// from "this name doesn't exist" and answered SERVFAIL instead of NXDOMAIN.
+func nameHasRecords(name string) (bool, error) {
+	pipe := redisClient.Pipeline()
+
+	cmds := make([]*redis.IntCmd, 0, len(zone.SupportedTypes))
+	for rrType := range zone.SupportedTypes {
+		cmds = append(cmds, pipe.Exists(zone.KeyForType(name, rrType)))
+	}
 
-	// TODO add support for IPv6 lookup
-	if queryResourceRecord.Class != ClassINET {
-		return answerResourceRecords, authorityResourceRecords, additionalResourceRecords
+	if _, err := pipe.Exec(); err != nil && err != redis.Nil {
+		redisErrorsTotal.Inc()
+		log.Println("Redis pipelined EXISTS error: ", err.Error())
+		return false, err
 	}
 
-	if queryResourceRecord.Type == TypeA || queryResourceRecord.Type == TypeAAAA {
-		//queryResourceRecord.DomainName
-		resolvedAddress := redisClient.Get(queryResourceRecord.DomainName)
-		if resolvedAddress.Val() == "" { // not in db, probably should return NXDOMAIN instead
-			return answerResourceRecords, authorityResourceRecords, additionalResourceRecords
+	for _, cmd := range cmds {
+		if cmd.Val() == 1 {
+			return true, nil
 		}
+	}
+
+	return false, nil
+}
+
+// ownsZoneFor reports whether name falls inside a zone this server
+// accepts dynamic updates for, even if that zone doesn't have any records
+// yet. Without this check a freshly delegated but still-empty zone would
+// fall through to the forwarder instead of answering NXDOMAIN itself.
+func ownsZoneFor(name string) bool {
+	for z := range updateZones {
+		if dns.IsSubDomain(z, name) {
+			return true
+		}
+	}
 
-		parsedAddress := net.ParseIP(resolvedAddress.Val())
-		log.Printf("%s resolved to %s (parsed %#v)", queryResourceRecord.DomainName, resolvedAddress, parsedAddress)
+	return false
+}
+
+// Response is the result of resolving a single DNS question.
+type Response struct {
+	Answer     []dns.RR
+	Authority  []dns.RR
+	Additional []dns.RR
+	Rcode      int
+
+	// Upstream is the forwarder address that answered this question, set
+	// by ForwarderResolver and left empty for anything answered locally.
+	// It's surfaced in the per-query log.
+	Upstream string
+}
+
+// Resolver resolves a single DNS question. A Resolver that has no opinion
+// on a question (it's outside the zone/scope it serves) returns
+// ErrNotAuthoritative so a ResolverChain can fall through to the next one.
+type Resolver interface {
+	Resolve(question dns.Question) (Response, error)
+}
 
-		// if queryResourceRecord.Type == TypeA {
-		if strings.Contains(queryResourceRecord.DomainName, "ip4") {
-			if queryResourceRecord.Type == TypeA {
-				answerResourceRecords = append(answerResourceRecords, DNSResourceRecord{
-					DomainName:         queryResourceRecord.DomainName,
-					Type:               TypeA,
-					Class:              ClassINET,
-					TimeToLive:         uint32(ExpiryTimeInSeconds),
-					ResourceData:       parsedAddress[12:16], // ipv4 address
-					ResourceDataLength: 4,
-				})
+// ErrNotAuthoritative is returned by a Resolver that declines to answer a
+// question because it falls outside what it's authoritative for.
+var ErrNotAuthoritative = errors.New("resolver is not authoritative for this question")
+
+// ResolverChain tries each Resolver in turn, returning the first
+// definitive answer. If every Resolver declines, the chain itself answers
+// NXDOMAIN, since that means nothing in the chain owns the name.
+type ResolverChain []Resolver
+
+func (chain ResolverChain) Resolve(question dns.Question) (Response, error) {
+	for _, resolver := range chain {
+		response, err := resolver.Resolve(question)
+		if err == ErrNotAuthoritative {
+			continue
+		}
+
+		return response, err
+	}
+
+	return Response{Rcode: dns.RcodeNameError}, nil
+}
+
+// RedisResolver serves the structured Redis-backed zone (see package
+// zone). It claims a question if the name already has records of any
+// supported type, or falls within a zone this server owns via
+// -update-zones; anything else is left to the next resolver in the chain.
+type RedisResolver struct{}
+
+func (RedisResolver) Resolve(question dns.Question) (Response, error) {
+	if question.Qclass != dns.ClassINET {
+		return Response{}, ErrNotAuthoritative
+	}
 
+	owned, err := nameHasRecords(question.Name)
+	if err != nil {
+		return Response{Rcode: dns.RcodeServerFailure}, nil
+	}
+	if !owned && !ownsZoneFor(question.Name) {
+		return Response{}, ErrNotAuthoritative
+	}
+
+	if !owned {
+		return Response{Rcode: dns.RcodeNameError}, nil // NXDOMAIN: we own the zone, the name just isn't in it
+	}
+
+	if !zone.SupportedTypes[question.Qtype] {
+		return Response{Rcode: dns.RcodeSuccess}, nil // NODATA: we own the name, just not this RR type
+	}
+
+	raw, err := redisGet(zone.KeyForType(question.Name, question.Qtype))
+	if err != nil {
+		return Response{Rcode: dns.RcodeServerFailure}, nil
+	}
+
+	if raw == "" {
+		// no RRset of the queried type, but the name might be a CNAME
+		// alias instead -- synthesize its answer rather than reporting
+		// NODATA, which tells resolvers to give up instead of following it.
+		if question.Qtype != dns.TypeCNAME {
+			cname, err := redisGet(zone.KeyForType(question.Name, dns.TypeCNAME))
+			if err != nil {
+				return Response{Rcode: dns.RcodeServerFailure}, nil
 			}
-			
-
-		} else if strings.Contains(queryResourceRecord.DomainName, "ip6") {
-
-			if queryResourceRecord.Type == TypeAAAA  {
-				answerResourceRecords = append(answerResourceRecords, DNSResourceRecord{
-					DomainName:         queryResourceRecord.DomainName,
-					Type:               TypeAAAA,
-					Class:              ClassINET,
-					TimeToLive:         uint32(ExpiryTimeInSeconds),
-					ResourceData:       parsedAddress, // ipv6 address
-					ResourceDataLength: 16,
-				})
-			} else { // if they queried a ipv6 name without querying the type AAAA, put it in the additional records
-				additionalResourceRecords = append(additionalResourceRecords, DNSResourceRecord{
-					DomainName:         queryResourceRecord.DomainName,
-					Type:               TypeAAAA,
-					Class:              ClassINET,
-					TimeToLive:         uint32(ExpiryTimeInSeconds),
-					ResourceData:       parsedAddress, // ipv6 address
-					ResourceDataLength: 16,
-				})
+			if cname != "" {
+				return resolveCNAME(question, cname)
 			}
-			
 		}
 
+		return Response{Rcode: dns.RcodeSuccess}, nil // NODATA
 	}
 
-	
-	
+	answerRRs, err := zone.DecodeRRSet(question.Name, question.Qtype, raw, uint32(ExpiryTimeInSeconds))
+	if err != nil {
+		log.Printf("Error decoding %s: %s", zone.KeyForType(question.Name, question.Qtype), err.Error())
+		return Response{Rcode: dns.RcodeServerFailure}, nil
+	}
 
-	
-	
+	return Response{Answer: answerRRs, Rcode: dns.RcodeSuccess}, nil
+}
 
+// resolveCNAME builds the Response for a question that has no RRset of its
+// own queried type but does have a CNAME RRset, by decoding and returning
+// that CNAME RRset as the answer. It doesn't chase the alias any further,
+// so the client (or the next resolver in its own chain) is left to follow it.
+func resolveCNAME(question dns.Question, raw string) (Response, error) {
+	cnameRRs, err := zone.DecodeRRSet(question.Name, dns.TypeCNAME, raw, uint32(ExpiryTimeInSeconds))
+	if err != nil {
+		log.Printf("Error decoding %s: %s", zone.KeyForType(question.Name, dns.TypeCNAME), err.Error())
+		return Response{Rcode: dns.RcodeServerFailure}, nil
+	}
 
-	return answerResourceRecords, authorityResourceRecords, additionalResourceRecords
+	return Response{Answer: cnameRRs, Rcode: dns.RcodeSuccess}, nil
 }
 
-// RFC1035: "Domain names in messages are expressed in terms of a sequence
-// of labels. Each label is represented as a one octet length field followed
-// by that number of octets.  Since every domain name ends with the null label
-// of the root, a domain name is terminated by a length byte of zero."
-func readDomainName(requestBuffer *bytes.Buffer) (string, error) {
-	var domainName string
+// ForwarderResolver forwards questions RedisResolver doesn't own to a set
+// of recursive/upstream servers, racing all of them in parallel per query
+// and returning the first definitive (NOERROR or NXDOMAIN) answer, or the
+// first other reply if no forwarder gives a definitive one.
+type ForwarderResolver struct {
+	Forwarders []string
+	Client     *dns.Client
+}
 
-	b, err := requestBuffer.ReadByte()
+// NewForwarderResolver builds a ForwarderResolver that queries forwarders
+// (e.g. "1.1.1.1:53") with the given per-query timeout.
+func NewForwarderResolver(forwarders []string, timeout time.Duration) *ForwarderResolver {
+	return &ForwarderResolver{
+		Forwarders: forwarders,
+		Client:     &dns.Client{Timeout: timeout},
+	}
+}
 
-	for ; b != 0 && err == nil; b, err = requestBuffer.ReadByte() {
-		labelLength := int(b)
-		labelBytes := requestBuffer.Next(labelLength)
-		labelName := string(labelBytes)
+// isAuthoritativeRcode reports whether rcode is a definitive answer
+// (NOERROR or NXDOMAIN) as opposed to a transient failure like SERVFAIL or
+// REFUSED that's worth waiting past in case another forwarder does better.
+func isAuthoritativeRcode(rcode int) bool {
+	return rcode == dns.RcodeSuccess || rcode == dns.RcodeNameError
+}
 
-		if len(domainName) == 0 {
-			domainName = labelName
-		} else {
-			domainName += "." + labelName
+func (r *ForwarderResolver) Resolve(question dns.Question) (Response, error) {
+	if len(r.Forwarders) == 0 {
+		return Response{}, ErrNotAuthoritative
+	}
+
+	query := new(dns.Msg)
+	query.SetQuestion(question.Name, question.Qtype)
+	query.Question[0].Qclass = question.Qclass
+	query.RecursionDesired = true
+
+	type exchange struct {
+		forwarder string
+		reply     *dns.Msg
+		err       error
+	}
+
+	results := make(chan exchange, len(r.Forwarders))
+
+	for _, forwarder := range r.Forwarders {
+		forwarder := forwarder
+
+		go func() {
+			reply, _, err := r.Client.Exchange(query, forwarder)
+			results <- exchange{forwarder, reply, err}
+		}()
+	}
+
+	var best *exchange
+	var lastErr error
+
+	for range r.Forwarders {
+		result := <-results
+
+		if result.err != nil {
+			lastErr = result.err
+			continue
+		}
+
+		if best == nil || (!isAuthoritativeRcode(best.reply.Rcode) && isAuthoritativeRcode(result.reply.Rcode)) {
+			result := result
+			best = &result
+		}
+
+		if isAuthoritativeRcode(best.reply.Rcode) {
+			break // a definitive answer is in hand; no need to wait on slower forwarders
+		}
+	}
+
+	if best == nil {
+		return Response{}, lastErr
+	}
+
+	return Response{
+		Answer:     best.reply.Answer,
+		Authority:  best.reply.Ns,
+		Additional: best.reply.Extra,
+		Rcode:      best.reply.Rcode,
+		Upstream:   best.forwarder,
+	}, nil
+}
+
+// cacheEntry is one entry in an lruCache: a cached Response alongside the
+// absolute time it stops being valid.
+type cacheEntry struct {
+	key      string
+	response Response
+	expires  time.Time
+}
+
+// lruCache is a small fixed-capacity, TTL-aware cache of Responses, used
+// to avoid hitting the forwarders again for a repeat question within
+// its TTL.
+type lruCache struct {
+	mu       sync.Mutex
+	capacity int
+	order    *list.List
+	entries  map[string]*list.Element
+}
+
+func newLRUCache(capacity int) *lruCache {
+	return &lruCache{
+		capacity: capacity,
+		order:    list.New(),
+		entries:  make(map[string]*list.Element),
+	}
+}
+
+func cacheKey(question dns.Question) string {
+	return strings.ToLower(question.Name) + "/" + dns.TypeToString[question.Qtype] + "/" + dns.ClassToString[question.Qclass]
+}
+
+func (c *lruCache) get(question dns.Question) (Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	elem, ok := c.entries[cacheKey(question)]
+	if !ok {
+		return Response{}, false
+	}
+
+	entry := elem.Value.(*cacheEntry)
+	if time.Now().After(entry.expires) {
+		c.order.Remove(elem)
+		delete(c.entries, entry.key)
+		return Response{}, false
+	}
+
+	c.order.MoveToFront(elem)
+	return entry.response, true
+}
+
+func (c *lruCache) set(question dns.Question, response Response, ttl uint32) {
+	if ttl == 0 {
+		return
+	}
+
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	key := cacheKey(question)
+
+	if elem, ok := c.entries[key]; ok {
+		c.order.Remove(elem)
+		delete(c.entries, key)
+	}
+
+	entry := &cacheEntry{key: key, response: response, expires: time.Now().Add(time.Duration(ttl) * time.Second)}
+	c.entries[key] = c.order.PushFront(entry)
+
+	for c.order.Len() > c.capacity {
+		oldest := c.order.Back()
+		if oldest == nil {
+			break
 		}
+
+		c.order.Remove(oldest)
+		delete(c.entries, oldest.Value.(*cacheEntry).key)
+	}
+}
+
+// responseTTL picks the TTL to cache a Response under: the lowest TTL
+// across its answer RRs for a positive response, or the SOA MINIMUM field
+// (RFC 2308 negative caching) for an NXDOMAIN, falling back to the
+// server's configured expiry if neither is present. Anything else (e.g. a
+// forwarder's SERVFAIL/REFUSED) gets a TTL of 0, meaning lruCache.set
+// won't cache it at all -- caching a transient upstream failure for the
+// configured expiry would poison every query for that name for however
+// long that is.
+func responseTTL(response Response) uint32 {
+	if response.Rcode == dns.RcodeSuccess && len(response.Answer) > 0 {
+		ttl := response.Answer[0].Header().Ttl
+
+		for _, rr := range response.Answer[1:] {
+			if rr.Header().Ttl < ttl {
+				ttl = rr.Header().Ttl
+			}
+		}
+
+		return ttl
+	}
+
+	if response.Rcode == dns.RcodeSuccess {
+		return uint32(ExpiryTimeInSeconds)
 	}
 
-	return domainName, err
+	if response.Rcode == dns.RcodeNameError {
+		for _, rr := range response.Authority {
+			if soa, ok := rr.(*dns.SOA); ok {
+				return soa.Minttl
+			}
+		}
+
+		return uint32(ExpiryTimeInSeconds)
+	}
+
+	return 0
 }
 
-// RFC1035: "Domain names in messages are expressed in terms of a sequence
-// of labels. Each label is represented as a one octet length field followed
-// by that number of octets.  Since every domain name ends with the null label
-// of the root, a domain name is terminated by a length byte of zero."
-func writeDomainName(responseBuffer *bytes.Buffer, domainName string) error {
-	labels := strings.Split(domainName, ".")
+// CachingResolver wraps another Resolver with a positive/negative
+// in-memory LRU cache honoring responseTTL.
+type CachingResolver struct {
+	inner Resolver
+	cache *lruCache
+}
 
-	for _, label := range labels {
-		labelLength := len(label)
-		labelBytes := []byte(label)
+// NewCachingResolver wraps inner with an LRU cache of the given capacity.
+func NewCachingResolver(inner Resolver, capacity int) *CachingResolver {
+	return &CachingResolver{inner: inner, cache: newLRUCache(capacity)}
+}
 
-		responseBuffer.WriteByte(byte(labelLength))
-		responseBuffer.Write(labelBytes)
+func (r *CachingResolver) Resolve(question dns.Question) (Response, error) {
+	if cached, ok := r.cache.get(question); ok {
+		cacheHitsTotal.Inc()
+		return cached, nil
 	}
 
-	err := responseBuffer.WriteByte(byte(0))
+	cacheMissesTotal.Inc()
 
-	return err
+	response, err := r.inner.Resolve(question)
+	if err != nil {
+		return response, err
+	}
+
+	r.cache.set(question, response, responseTTL(response))
+
+	return response, nil
 }
 
-func handleDNSClient(requestBytes []byte, serverConn *net.UDPConn, clientAddr *net.UDPAddr) {
-	/**
-	 * read request
-	 */
-	var requestBuffer = bytes.NewBuffer(requestBytes)
-	var queryHeader DNSHeader
-	var queryResourceRecords []DNSResourceRecord
+// resolver is the server's full resolver chain: Redis-authoritative
+// lookups first, then upstream forwarding wrapped in an LRU cache.
+// Configured once in main().
+var resolver Resolver
 
-	err := binary.Read(requestBuffer, binary.BigEndian, &queryHeader) // network byte order is big endian
+// loadTsigKeys reads a "<key-name> <base64-secret>" per line config file,
+// skipping blank lines and '#' comments. An empty path yields no keys,
+// which means dynamic updates are rejected outright.
+func loadTsigKeys(path string) (map[string]string, error) {
+	keys := make(map[string]string)
 
+	if path == "" {
+		return keys, nil
+	}
+
+	file, err := os.Open(path)
 	if err != nil {
-		log.Println("Error decoding header: ", err.Error())
+		return nil, err
+	}
+	defer file.Close()
+
+	scanner := bufio.NewScanner(file)
+
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+
+		fields := strings.Fields(line)
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("invalid line in tsig keyfile %s: %q", path, line)
+		}
+
+		keys[dns.Fqdn(fields[0])] = fields[1]
+	}
+
+	return keys, scanner.Err()
+}
+
+// tsigContext carries what's needed to sign a dynamic update's response in
+// kind, per RFC 2845 §4: a signed request always gets a signed response,
+// whether or not it verified. keyName is "" if the request carried no TSIG
+// RR at all, in which case the response isn't signed either.
+type tsigContext struct {
+	keyName    string
+	algorithm  string
+	secret     string
+	requestMAC string
+	tsigError  int // TSIG RR Error field: RcodeSuccess, RcodeBadKey or RcodeBadSig
+}
+
+// verifyUpdateTsig authenticates the trailing TSIG RR (RFC 2845) on a
+// dynamic update. It returns RcodeSuccess if the MAC is valid, RcodeRefused
+// if the update is unsigned or signed by a key we don't know, or
+// RcodeBadSig if the signature or the time-fudge check fails, alongside
+// the tsigContext the caller needs to sign the response in kind.
+func verifyUpdateTsig(query *dns.Msg, requestBytes []byte) (int, tsigContext) {
+	tsigRR := query.IsTsig()
+	if tsigRR == nil {
+		return dns.RcodeRefused, tsigContext{}
+	}
+
+	ctx := tsigContext{
+		keyName:    tsigRR.Hdr.Name,
+		algorithm:  tsigRR.Algorithm,
+		requestMAC: tsigRR.MAC,
+	}
+
+	secret, ok := tsigKeys[tsigRR.Hdr.Name]
+	if !ok {
+		ctx.tsigError = dns.RcodeBadKey
+		return dns.RcodeRefused, ctx
+	}
+	ctx.secret = secret
+
+	if err := dns.TsigVerify(requestBytes, secret, "", false); err != nil {
+		log.Println("TSIG verification failed: ", err.Error())
+		ctx.tsigError = dns.RcodeBadSig
+		return dns.RcodeBadSig, ctx
 	}
 
-	queryResourceRecords = make([]DNSResourceRecord, queryHeader.NumQuestions)
+	ctx.tsigError = dns.RcodeSuccess
+	return dns.RcodeSuccess, ctx
+}
+
+// checkPrerequisites evaluates the RFC 2136 §2.4 prerequisites against the
+// Redis-backed zone: name is/is not in use (class ANY/NONE, type ANY) and
+// RRset exists/does not exist (class ANY/NONE, a specific type).
+func checkPrerequisites(query *dns.Msg) int {
+	for _, rr := range query.Answer {
+		header := rr.Header()
+
+		switch {
+		case header.Class == dns.ClassANY && header.Rrtype == dns.TypeANY:
+			owned, err := nameHasRecords(header.Name)
+			if err != nil {
+				return dns.RcodeServerFailure
+			}
+			if !owned {
+				return dns.RcodeNameError // name is not in use
+			}
+		case header.Class == dns.ClassNONE && header.Rrtype == dns.TypeANY:
+			owned, err := nameHasRecords(header.Name)
+			if err != nil {
+				return dns.RcodeServerFailure
+			}
+			if owned {
+				return dns.RcodeYXDomain // name is in use
+			}
+		case header.Class == dns.ClassANY:
+			if !redisExists(zone.KeyForType(header.Name, header.Rrtype)) {
+				return dns.RcodeNXRrset // RRset does not exist
+			}
+		case header.Class == dns.ClassNONE:
+			if redisExists(zone.KeyForType(header.Name, header.Rrtype)) {
+				return dns.RcodeYXRrset // RRset exists
+			}
+		}
+	}
+
+	return dns.RcodeSuccess
+}
+
+// applyUpdate translates a single RR from the Update section into a Redis
+// mutation against the structured zone schema (see package zone). ADD
+// (class INET) appends the record to its type's RRset; DELETE an RRset
+// (class ANY, a specific type) removes that type entirely at the name;
+// DELETE a name (class ANY, type ANY) removes every RRset at that name;
+// DELETE one record (class NONE) removes just the matching record from
+// its RRset. Adding an A record also provisions the matching PTR record
+// under in-addr.arpa, so reverse lookups stay consistent automatically.
+func applyUpdate(rr dns.RR) int {
+	header := rr.Header()
+
+	switch {
+	case header.Class == dns.ClassANY && header.Rrtype == dns.TypeANY:
+		for rrType := range zone.SupportedTypes {
+			redisDel(zone.KeyForType(header.Name, rrType))
+		}
+		return dns.RcodeSuccess
+
+	case header.Class == dns.ClassANY:
+		redisDel(zone.KeyForType(header.Name, header.Rrtype))
+		return dns.RcodeSuccess
+
+	case header.Class == dns.ClassNONE:
+		record, err := zone.RecordFor(rr)
+		if err != nil {
+			return dns.RcodeNotImplemented
+		}
+
+		key := zone.KeyForType(header.Name, header.Rrtype)
 
-	for idx, _ := range queryResourceRecords {
-		queryResourceRecords[idx].DomainName, err = readDomainName(requestBuffer)
+		raw, err := redisGet(key)
+		if err != nil {
+			return dns.RcodeServerFailure
+		}
 
+		updated, empty, err := zone.RemoveRecord(raw, record)
 		if err != nil {
-			log.Println("Error decoding label: ", err.Error())
+			log.Println("Error removing record: ", err.Error())
+			return dns.RcodeServerFailure
+		}
+
+		if empty {
+			redisDel(key)
+		} else {
+			redisSet(key, updated, 0)
 		}
 
-		queryResourceRecords[idx].Type = binary.BigEndian.Uint16(requestBuffer.Next(2))
-		queryResourceRecords[idx].Class = binary.BigEndian.Uint16(requestBuffer.Next(2))
+		return dns.RcodeSuccess
+	}
+
+	if !zone.SupportedTypes[header.Rrtype] {
+		return dns.RcodeNotImplemented
+	}
+
+	record, err := zone.RecordFor(rr)
+	if err != nil {
+		return dns.RcodeNotImplemented
+	}
+
+	key := zone.KeyForType(header.Name, header.Rrtype)
+
+	raw, err := redisGet(key)
+	if err != nil {
+		return dns.RcodeServerFailure
 	}
 
-	/**
-	 * lookup values
-	 */
-	var answerResourceRecords = make([]DNSResourceRecord, 0)
-	var authorityResourceRecords = make([]DNSResourceRecord, 0)
-	var additionalResourceRecords = make([]DNSResourceRecord, 0)
+	updated, err := zone.AppendRecord(raw, record)
+	if err != nil {
+		log.Println("Error appending record: ", err.Error())
+		return dns.RcodeServerFailure
+	}
 
-	for _, queryResourceRecord := range queryResourceRecords {
-		newAnswerRR, newAuthorityRR, newAdditionalRR := dbLookup(queryResourceRecord)
+	redisSet(key, updated, 0)
 
-		answerResourceRecords = append(answerResourceRecords, newAnswerRR...) // three dots cause the two lists to be concatenated
-		authorityResourceRecords = append(authorityResourceRecords, newAuthorityRR...)
-		additionalResourceRecords = append(additionalResourceRecords, newAdditionalRR...)
+	if a, ok := rr.(*dns.A); ok {
+		provisionPTR(a.A, header.Name, header.Ttl)
 	}
 
-	/**
-	 * write response
-	 */
-	var responseBuffer = new(bytes.Buffer)
-	var responseHeader DNSHeader
+	return dns.RcodeSuccess
+}
 
-	responseHeader = DNSHeader{
-		TransactionID:  queryHeader.TransactionID,
-		Flags:          FlagResponse,
-		NumQuestions:   queryHeader.NumQuestions,
-		NumAnswers:     uint16(len(answerResourceRecords)),
-		NumAuthorities: uint16(len(authorityResourceRecords)),
-		NumAdditionals: uint16(len(additionalResourceRecords)),
+// provisionPTR adds a PTR record resolving ip's in-addr.arpa owner name
+// back to target, so a dynamic update that adds an A record stays
+// reverse-resolvable without a separate update for the PTR record.
+func provisionPTR(ip net.IP, target string, ttl uint32) {
+	arpaName, err := zone.PTRZoneName(ip)
+	if err != nil {
+		log.Println("Error computing PTR zone name: ", err.Error())
+		return
 	}
 
-	err = Write(responseBuffer, &responseHeader)
+	key := zone.Key(arpaName, "PTR")
+
+	raw, err := redisGet(key)
+	if err != nil {
+		return
+	}
 
+	updated, err := zone.AppendRecord(raw, zone.PTRRecord{Target: dns.Fqdn(target), TTL: ttl})
 	if err != nil {
-		log.Println("Error writing to buffer: ", err.Error())
+		log.Println("Error provisioning PTR record: ", err.Error())
+		return
 	}
 
-	for _, queryResourceRecord := range queryResourceRecords {
-		err = writeDomainName(responseBuffer, queryResourceRecord.DomainName)
+	redisSet(key, updated, 0)
+}
+
+// handleUpdate processes an RFC 2136 dynamic update: it authenticates the
+// TSIG signature, confirms the server owns the target zone, checks the
+// prerequisite section, then applies every ADD/DELETE in the Update
+// section to the Redis-backed zone. The second return value is the
+// tsigContext needed to sign the response in kind, for the caller to pass
+// to packResponse instead of packing it plain.
+func handleUpdate(query *dns.Msg, requestBytes []byte) (*dns.Msg, tsigContext) {
+	response := new(dns.Msg)
+	response.Id = query.Id
+	response.Response = true
+	response.Opcode = dns.OpcodeUpdate
+	response.Question = query.Question
+
+	rcode, tsig := verifyUpdateTsig(query, requestBytes)
+
+	if len(query.Question) != 1 || query.Question[0].Qtype != dns.TypeSOA {
+		response.Rcode = dns.RcodeFormatError
+		return response, tsig
+	}
+
+	qzone := query.Question[0]
+
+	if rcode != dns.RcodeSuccess {
+		response.Rcode = rcode
+		return response, tsig
+	}
+
+	if !updateZones[strings.ToLower(qzone.Name)] {
+		response.Rcode = dns.RcodeNotAuth
+		return response, tsig
+	}
+
+	if rcode := checkPrerequisites(query); rcode != dns.RcodeSuccess {
+		response.Rcode = rcode
+		return response, tsig
+	}
+
+	for _, rr := range query.Ns {
+		if !dns.IsSubDomain(qzone.Name, rr.Header().Name) {
+			response.Rcode = dns.RcodeNotZone
+			return response, tsig
+		}
+
+		if rcode := applyUpdate(rr); rcode != dns.RcodeSuccess {
+			response.Rcode = rcode
+			return response, tsig
+		}
+	}
+
+	response.Rcode = dns.RcodeSuccess
+	return response, tsig
+}
+
+// dispatch routes a decoded query to the dynamic-update handler or to the
+// ordinary lookup path, based on its Opcode. The second return value is
+// the upstream forwarder that answered, if any, for the per-query log. The
+// third is the tsigContext needed to sign the response in kind, non-zero
+// only for a dynamic update whose request carried a TSIG RR.
+func dispatch(query *dns.Msg, requestBytes []byte) (*dns.Msg, string, tsigContext) {
+	if query.Opcode == dns.OpcodeUpdate {
+		response, tsig := handleUpdate(query, requestBytes)
+		return response, "", tsig
+	}
+
+	response, upstream := buildResponse(query)
+	return response, upstream, tsigContext{}
+}
 
+// buildResponse runs every question in query through the resolver chain and
+// assembles the resulting answer/authority/additional sections into a
+// reply. It is shared by every front-end. The second return value is the
+// comma-joined set of upstream forwarders consulted, if any.
+func buildResponse(query *dns.Msg) (*dns.Msg, string) {
+	response := new(dns.Msg)
+	response.Id = query.Id
+	response.Response = true
+	response.Opcode = query.Opcode
+	response.RecursionDesired = query.RecursionDesired
+	response.RecursionAvailable = true
+	response.Question = query.Question
+	response.Rcode = dns.RcodeSuccess
+
+	var upstreams []string
+
+	for _, question := range query.Question {
+		result, err := resolver.Resolve(question)
 		if err != nil {
-			log.Println("Error writing to buffer: ", err.Error())
+			log.Println("Error resolving question: ", err.Error())
+			result = Response{Rcode: dns.RcodeServerFailure}
 		}
 
-		Write(responseBuffer, queryResourceRecord.Type)
-		Write(responseBuffer, queryResourceRecord.Class)
+		response.Answer = append(response.Answer, result.Answer...)
+		response.Ns = append(response.Ns, result.Authority...)
+		response.Extra = append(response.Extra, result.Additional...)
+
+		if result.Upstream != "" {
+			upstreams = append(upstreams, result.Upstream)
+		}
+
+		// the last non-success RCODE across all questions wins, same as
+		// before when every lookup shared a single response header
+		if result.Rcode != dns.RcodeSuccess {
+			response.Rcode = result.Rcode
+		}
+	}
+
+	return response, strings.Join(upstreams, ",")
+}
+
+// recordQuery emits one structured (logfmt) log line for a processed
+// query and updates the dns_requests_total/dns_request_duration_seconds/
+// dns_response_size_bytes Prometheus collectors.
+func recordQuery(proto, client string, id uint16, qname, qtype string, rcode, answers int, upstream string, responseBytes int, elapsed time.Duration) {
+	rcodeName, ok := dns.RcodeToString[rcode]
+	if !ok {
+		rcodeName = strconv.Itoa(rcode)
+	}
+
+	log.Printf(
+		"proto=%s client=%s id=%d qname=%q qtype=%s rcode=%s answers=%d upstream=%q bytes=%d duration_ms=%.2f",
+		proto, client, id, qname, qtype, rcodeName, answers, upstream, responseBytes, float64(elapsed.Microseconds())/1000,
+	)
+
+	requestsTotal.WithLabelValues(proto, qtype, rcodeName).Inc()
+	requestDuration.WithLabelValues(proto).Observe(elapsed.Seconds())
+	responseSizeBytes.WithLabelValues(proto).Observe(float64(responseBytes))
+}
+
+// packResponse packs response to wire format, signing it per RFC 2845 §4.1
+// when tsig says the request that produced it carried a TSIG RR -- a
+// signed request always gets a signed response, valid or not, or clients
+// that verify the response MAC (e.g. Terraform's dns provider, nsupdate)
+// reject an unsigned reply outright. The stub TSIG RR is appended here,
+// after truncation/EDNS0, so it's guaranteed to be the last RR as
+// TsigGenerate requires.
+func packResponse(response *dns.Msg, tsig tsigContext) ([]byte, error) {
+	if tsig.keyName == "" {
+		return response.Pack()
+	}
+
+	response.SetTsig(tsig.keyName, tsig.algorithm, 300, time.Now().Unix())
+	response.Extra[len(response.Extra)-1].(*dns.TSIG).Error = uint16(tsig.tsigError)
+
+	packed, _, err := dns.TsigGenerate(response, tsig.secret, tsig.requestMAC, false)
+	return packed, err
+}
+
+// processQuery is the transport-agnostic core of the server: unpack wire
+// format bytes, dispatch the decoded message to a response, and pack the
+// response back to wire format, capped at maxResponseSize (RFC 6891's
+// EDNS0 OPT is echoed back if the client sent one). UDP, TCP, DoT and DoH
+// all funnel through this, each supplying whatever size cap makes sense
+// for its transport. proto and client identify the transport and caller
+// for the per-query log and metrics.
+func processQuery(requestBytes []byte, maxResponseSize int, proto, client string) []byte {
+	start := time.Now()
+
+	var query dns.Msg
+
+	if err := query.Unpack(requestBytes); err != nil {
+		log.Println("Error decoding request: ", err.Error())
+
+		// Unpack calls setHdr before parsing the body, so query.Id/Opcode/
+		// RecursionDesired are already populated even though it returned an
+		// error -- echo them back, the same as every other response path in
+		// this file, so the client can tell this FORMERR apart from an
+		// unsolicited/off-path packet instead of treating it as a timeout.
+		response := new(dns.Msg)
+		response.Id = query.Id
+		response.Response = true
+		response.Opcode = query.Opcode
+		response.RecursionDesired = query.RecursionDesired
+		response.Rcode = dns.RcodeFormatError
+
+		responseBytes, err := response.Pack()
+		if err != nil {
+			log.Println("Error packing response: ", err.Error())
+			return nil
+		}
+
+		recordQuery(proto, client, query.Id, "", "", response.Rcode, 0, "", len(responseBytes), time.Since(start))
+		return responseBytes
+	}
+
+	response, upstream, tsig := dispatch(&query, requestBytes)
+
+	if opt := query.IsEdns0(); opt != nil {
+		response.SetEdns0(maxUDPPayloadSize, opt.Do())
+	}
+
+	// sets TC and drops answers that don't fit when maxResponseSize is
+	// small (UDP); a no-op for transports that pass their own large cap
+	response.Truncate(maxResponseSize)
+
+	// Truncate turns compression off for a message that fits uncompressed;
+	// always compress names in the packed response
+	response.Compress = true
+
+	responseBytes, err := packResponse(response, tsig)
+
+	if err != nil {
+		log.Println("Error packing response: ", err.Error())
+		return nil
+	}
+
+	var qname, qtype string
+	if len(query.Question) > 0 {
+		qname = query.Question[0].Name
+		qtype = dns.TypeToString[query.Question[0].Qtype]
+	}
+
+	recordQuery(proto, client, query.Id, qname, qtype, response.Rcode, len(response.Answer), upstream, len(responseBytes), time.Since(start))
+
+	return responseBytes
+}
+
+func handleDNSClient(requestBytes []byte, serverConn *net.UDPConn, clientAddr *net.UDPAddr) {
+	// honor the client's advertised EDNS0 UDP payload size (RFC 6891),
+	// falling back to the RFC 1035 512-byte default when no OPT is present
+	clientUDPSize := defaultUDPPayloadSize
+
+	var query dns.Msg
+	if err := query.Unpack(requestBytes); err == nil {
+		if opt := query.IsEdns0(); opt != nil {
+			if size := int(opt.UDPSize()); size > clientUDPSize {
+				clientUDPSize = size
+			}
+		}
+	}
+	if clientUDPSize > maxUDPPayloadSize {
+		clientUDPSize = maxUDPPayloadSize
+	}
+
+	responseBytes := processQuery(requestBytes, clientUDPSize, "udp", clientAddr.String())
+	if responseBytes == nil {
+		return
+	}
+
+	serverConn.WriteToUDP(responseBytes, clientAddr)
+}
+
+// readLengthPrefixed reads one 2-byte-length-prefixed DNS message (RFC
+// 1035 §4.2.2) from r.
+func readLengthPrefixed(r io.Reader) ([]byte, error) {
+	lengthPrefix := make([]byte, 2)
+	if _, err := io.ReadFull(r, lengthPrefix); err != nil {
+		return nil, err
 	}
 
-	for _, answerResourceRecord := range answerResourceRecords {
-		err = writeDomainName(responseBuffer, answerResourceRecord.DomainName)
+	requestBytes := make([]byte, binary.BigEndian.Uint16(lengthPrefix))
+	if _, err := io.ReadFull(r, requestBytes); err != nil {
+		return nil, err
+	}
+
+	return requestBytes, nil
+}
+
+// writeLengthPrefixed writes one 2-byte-length-prefixed DNS message to w.
+func writeLengthPrefixed(w io.Writer, responseBytes []byte) error {
+	lengthPrefix := make([]byte, 2)
+	binary.BigEndian.PutUint16(lengthPrefix, uint16(len(responseBytes)))
+
+	_, err := w.Write(append(lengthPrefix, responseBytes...))
+	return err
+}
+
+// handleTCPConn services length-prefixed DNS queries on a single TCP
+// connection (RFC 1035 §4.2.2) until the client closes it or a framing
+// error occurs. Unlike UDP, TCP responses are never truncated. proto
+// distinguishes plain TCP from DoT in the per-query log and metrics,
+// since both share this same framing and handler.
+func handleTCPConn(conn net.Conn, proto string) {
+	defer conn.Close()
+
+	client := conn.RemoteAddr().String()
 
+	for {
+		requestBytes, err := readLengthPrefixed(conn)
 		if err != nil {
-			log.Println("Error writing to buffer: ", err.Error())
+			return // client closed the connection, or a framing error
+		}
+
+		responseBytes := processQuery(requestBytes, dns.MaxMsgSize, proto, client)
+		if responseBytes == nil {
+			return
 		}
 
-		Write(responseBuffer, answerResourceRecord.Type)
-		Write(responseBuffer, answerResourceRecord.Class)
-		Write(responseBuffer, answerResourceRecord.TimeToLive)
-		Write(responseBuffer, answerResourceRecord.ResourceDataLength)
-		Write(responseBuffer, answerResourceRecord.ResourceData)
+		if err := writeLengthPrefixed(conn, responseBytes); err != nil {
+			log.Println("Error writing TCP response: ", err.Error())
+			return
+		}
 	}
+}
 
-	for _, authorityResourceRecord := range authorityResourceRecords {
-		err = writeDomainName(responseBuffer, authorityResourceRecord.DomainName)
+func serveTCP(addr *net.TCPAddr) {
+	listener, err := net.ListenTCP("tcp", addr)
+
+	if err != nil {
+		log.Println("Error listening on TCP: ", err.Error())
+		os.Exit(1)
+	}
+
+	defer listener.Close()
+
+	log.Println("Listening (TCP) at: ", addr)
+
+	for {
+		conn, err := listener.Accept()
 
 		if err != nil {
-			log.Println("Error writing to buffer: ", err.Error())
+			log.Println("Error accepting TCP connection: ", err.Error())
+			continue
 		}
 
-		Write(responseBuffer, authorityResourceRecord.Type)
-		Write(responseBuffer, authorityResourceRecord.Class)
-		Write(responseBuffer, authorityResourceRecord.TimeToLive)
-		Write(responseBuffer, authorityResourceRecord.ResourceDataLength)
-		Write(responseBuffer, authorityResourceRecord.ResourceData)
+		go handleTCPConn(conn, "tcp")
+	}
+}
+
+// serveDoT runs a DNS-over-TLS listener (RFC 7858): identical framing to
+// plain TCP DNS, just wrapped in a TLS handshake.
+func serveDoT(addr, certFile, keyFile string) {
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+
+	if err != nil {
+		log.Println("Error loading TLS certificate: ", err.Error())
+		os.Exit(1)
 	}
 
-	for _, additionalResourceRecord := range additionalResourceRecords {
-		err = writeDomainName(responseBuffer, additionalResourceRecord.DomainName)
+	listener, err := tls.Listen("tcp", addr, &tls.Config{Certificates: []tls.Certificate{cert}})
+
+	if err != nil {
+		log.Println("Error listening (DoT): ", err.Error())
+		os.Exit(1)
+	}
+
+	defer listener.Close()
+
+	log.Println("Listening (DoT) at: ", addr)
+
+	for {
+		conn, err := listener.Accept()
 
 		if err != nil {
-			log.Println("Error writing to buffer: ", err.Error())
+			log.Println("Error accepting DoT connection: ", err.Error())
+			continue
 		}
 
-		Write(responseBuffer, additionalResourceRecord.Type)
-		Write(responseBuffer, additionalResourceRecord.Class)
-		Write(responseBuffer, additionalResourceRecord.TimeToLive)
-		Write(responseBuffer, additionalResourceRecord.ResourceDataLength)
-		Write(responseBuffer, additionalResourceRecord.ResourceData)
+		go handleTCPConn(conn, "dot")
 	}
+}
 
-	serverConn.WriteToUDP(responseBuffer.Bytes(), clientAddr)
+// dohMessageMaxBytes bounds how much of a DoH POST body we'll read, per
+// the "application/dns-message" framing used by RFC 8484.
+const dohMessageMaxBytes = dns.MaxMsgSize
+
+// serveDoH runs a DNS-over-HTTPS listener (RFC 8484) exposing /dns-query,
+// accepting both GET ?dns=<base64url> and POST application/dns-message.
+func serveDoH(addr, certFile, keyFile string) {
+	mux := http.NewServeMux()
+
+	mux.HandleFunc("/dns-query", func(w http.ResponseWriter, r *http.Request) {
+		var requestBytes []byte
+		var err error
+
+		switch r.Method {
+		case http.MethodGet:
+			requestBytes, err = base64.RawURLEncoding.DecodeString(r.URL.Query().Get("dns"))
+		case http.MethodPost:
+			if r.Header.Get("Content-Type") != "application/dns-message" {
+				http.Error(w, "unsupported content type", http.StatusUnsupportedMediaType)
+				return
+			}
+			requestBytes, err = io.ReadAll(io.LimitReader(r.Body, dohMessageMaxBytes))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+
+		if err != nil {
+			http.Error(w, "malformed dns parameter", http.StatusBadRequest)
+			return
+		}
+
+		responseBytes := processQuery(requestBytes, dns.MaxMsgSize, "doh", r.RemoteAddr)
+		if responseBytes == nil {
+			http.Error(w, "failed to build response", http.StatusInternalServerError)
+			return
+		}
+
+		w.Header().Set("Content-Type", "application/dns-message")
+		w.Write(responseBytes)
+	})
+
+	server := &http.Server{Addr: addr, Handler: mux}
+
+	log.Println("Listening (DoH) at: ", addr)
+
+	if err := server.ListenAndServeTLS(certFile, keyFile); err != nil {
+		log.Println("Error serving DoH: ", err.Error())
+		os.Exit(1)
+	}
 }
 
 func main() {
 
 	port := flag.String("port", "1053", "port to listen on")
 	flag.UintVar(&ExpiryTimeInSeconds, "expiry", 1800, "expiry time in seconds")
-	
+	tsigKeyfile := flag.String("tsig-keyfile", "", "path to a \"<key-name> <base64-secret>\" per line file of hmac-sha256 TSIG keys allowed to send dynamic updates")
+	updateZonesFlag := flag.String("update-zones", "", "comma-separated list of zone names this server accepts RFC 2136 dynamic updates for")
+	tlsCert := flag.String("tls-cert", "", "path to a TLS certificate; required to enable the DoT and/or DoH listeners")
+	tlsKey := flag.String("tls-key", "", "path to the TLS certificate's private key")
+	dotAddr := flag.String("dot-addr", "", "address to listen on for DNS-over-TLS (e.g. :853); disabled when unset")
+	dohAddr := flag.String("doh-addr", "", "address to listen on for DNS-over-HTTPS (e.g. :443); disabled when unset")
+	forwardersFlag := flag.String("forwarders", "", "comma-separated list of upstream resolvers to forward queries outside our zone to (e.g. 1.1.1.1:53,8.8.8.8:53)")
+	forwardTimeout := flag.Duration("forward-timeout", 2*time.Second, "per-query timeout when racing -forwarders")
+	cacheSize := flag.Int("cache-size", 10000, "number of resolved questions to keep in the in-memory LRU cache")
+	metricsAddr := flag.String("metrics-addr", "", "address to serve Prometheus metrics on at /metrics (e.g. :9153); disabled when unset")
+
 	flag.Parse()
 
-	serverAddr, err := net.ResolveUDPAddr("udp", "0.0.0.0:"+ *port)
+	keys, err := loadTsigKeys(*tsigKeyfile)
+
+	if err != nil {
+		log.Println("Error loading tsig keyfile: ", err.Error())
+		os.Exit(1)
+	}
+
+	tsigKeys = keys
+
+	for _, zoneName := range strings.Split(*updateZonesFlag, ",") {
+		if zoneName = strings.TrimSpace(zoneName); zoneName != "" {
+			updateZones[dns.Fqdn(strings.ToLower(zoneName))] = true
+		}
+	}
+
+	var forwarders []string
+	for _, forwarder := range strings.Split(*forwardersFlag, ",") {
+		if forwarder = strings.TrimSpace(forwarder); forwarder != "" {
+			forwarders = append(forwarders, forwarder)
+		}
+	}
+
+	// RedisResolver is authoritative and already live-reads the zone on
+	// every query, so it's left out of the cache: wrapping it here would
+	// mean a dynamic update (chunk0-3's ADD/DELETE) against a name queried
+	// even once beforehand stays invisible to ordinary lookups until the
+	// stale cache entry expires. Only the forwarder, whose answers are
+	// genuinely expensive to re-fetch, is cached.
+	resolver = ResolverChain{
+		RedisResolver{},
+		NewCachingResolver(NewForwarderResolver(forwarders, *forwardTimeout), *cacheSize),
+	}
 
+	serverAddr, err := net.ResolveUDPAddr("udp", "0.0.0.0:"+*port)
 
 	if err != nil {
 		log.Println("Error resolving UDP address: ", err.Error())
@@ -333,26 +1211,53 @@ func main() {
 		os.Exit(1)
 	}
 
+	tcpAddr, err := net.ResolveTCPAddr("tcp", "0.0.0.0:"+*port)
+
+	if err != nil {
+		log.Println("Error resolving TCP address: ", err.Error())
+		os.Exit(1)
+	}
+
 	redisClient = redis.NewClient(&redis.Options{
-	    Addr: "localhost:6379",
-	    Password: "",
-	    DB: 0,
+		Addr:     "localhost:6379",
+		Password: "",
+		DB:       0,
 	})
 
 	log.Println("Listening at: ", serverAddr)
 
 	defer serverConn.Close()
 
+	go serveTCP(tcpAddr)
+
+	if *dotAddr != "" || *dohAddr != "" {
+		if *tlsCert == "" || *tlsKey == "" {
+			log.Println("Error: -tls-cert and -tls-key are required to enable DoT/DoH")
+			os.Exit(1)
+		}
+	}
+
+	if *dotAddr != "" {
+		go serveDoT(*dotAddr, *tlsCert, *tlsKey)
+	}
+
+	if *dohAddr != "" {
+		go serveDoH(*dohAddr, *tlsCert, *tlsKey)
+	}
+
+	if *metricsAddr != "" {
+		go serveMetrics(*metricsAddr)
+	}
+
 	for {
-		requestBytes := make([]byte, UDPMaxMessageSizeBytes)
+		requestBytes := make([]byte, maxUDPPayloadSize)
 
-		_, clientAddr, err := serverConn.ReadFromUDP(requestBytes)
+		n, clientAddr, err := serverConn.ReadFromUDP(requestBytes)
 
 		if err != nil {
 			log.Println("Error receiving: ", err.Error())
 		} else {
-			log.Println("Received request from ", clientAddr)
-			go handleDNSClient(requestBytes, serverConn, clientAddr) // array is value type (call-by-value), i.e. copied
+			go handleDNSClient(requestBytes[:n], serverConn, clientAddr) // array is value type (call-by-value), i.e. copied
 		}
 	}
 }
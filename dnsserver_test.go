@@ -0,0 +1,232 @@
+package main
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/miekg/dns"
+)
+
+func signedUpdate(t *testing.T, keyName, secret string) (*dns.Msg, []byte) {
+	t.Helper()
+
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeSOA)
+	query.Opcode = dns.OpcodeUpdate
+	query.SetTsig(keyName, dns.HmacSHA256, 300, time.Now().Unix())
+
+	requestBytes, _, err := dns.TsigGenerate(query, secret, "", false)
+	if err != nil {
+		t.Fatalf("TsigGenerate: %v", err)
+	}
+
+	var unpacked dns.Msg
+	if err := unpacked.Unpack(requestBytes); err != nil {
+		t.Fatalf("Unpack: %v", err)
+	}
+
+	return &unpacked, requestBytes
+}
+
+func TestVerifyUpdateTsig(t *testing.T) {
+	const keyName = "test-key."
+	const secret = "c3VwZXJzZWNyZXQ=" // base64 of an arbitrary HMAC secret
+
+	tsigKeys = map[string]string{keyName: secret}
+	defer func() { tsigKeys = map[string]string{} }()
+
+	t.Run("valid signature", func(t *testing.T) {
+		query, requestBytes := signedUpdate(t, keyName, secret)
+
+		rcode, ctx := verifyUpdateTsig(query, requestBytes)
+		if rcode != dns.RcodeSuccess {
+			t.Fatalf("rcode = %s, want NOERROR", dns.RcodeToString[rcode])
+		}
+		if ctx.keyName != keyName || ctx.secret != secret {
+			t.Fatalf("ctx = %+v, want keyName %q secret %q", ctx, keyName, secret)
+		}
+	})
+
+	t.Run("unknown key name", func(t *testing.T) {
+		query, requestBytes := signedUpdate(t, "unknown-key.", secret)
+
+		rcode, ctx := verifyUpdateTsig(query, requestBytes)
+		if rcode != dns.RcodeRefused {
+			t.Fatalf("rcode = %s, want REFUSED", dns.RcodeToString[rcode])
+		}
+		if ctx.tsigError != dns.RcodeBadKey {
+			t.Fatalf("tsigError = %d, want BADKEY", ctx.tsigError)
+		}
+	})
+
+	t.Run("tampered request body", func(t *testing.T) {
+		query, requestBytes := signedUpdate(t, keyName, secret)
+
+		// flip a byte inside the packed question (just past the 12-byte
+		// header), leaving the trailing TSIG RR (and its MAC) untouched.
+		requestBytes[13] ^= 0xff
+
+		rcode, ctx := verifyUpdateTsig(query, requestBytes)
+		if rcode != dns.RcodeBadSig {
+			t.Fatalf("rcode = %s, want BADSIG", dns.RcodeToString[rcode])
+		}
+		if ctx.tsigError != dns.RcodeBadSig {
+			t.Fatalf("tsigError = %d, want BADSIG", ctx.tsigError)
+		}
+	})
+
+	t.Run("no TSIG RR", func(t *testing.T) {
+		query := new(dns.Msg)
+		query.SetQuestion("example.com.", dns.TypeSOA)
+		query.Opcode = dns.OpcodeUpdate
+		requestBytes, err := query.Pack()
+		if err != nil {
+			t.Fatalf("Pack: %v", err)
+		}
+
+		rcode, ctx := verifyUpdateTsig(query, requestBytes)
+		if rcode != dns.RcodeRefused {
+			t.Fatalf("rcode = %s, want REFUSED", dns.RcodeToString[rcode])
+		}
+		if ctx.keyName != "" {
+			t.Fatalf("ctx.keyName = %q, want empty", ctx.keyName)
+		}
+	})
+}
+
+func TestResponseTTL(t *testing.T) {
+	ExpiryTimeInSeconds = 1800
+
+	t.Run("positive answer picks the lowest RR TTL", func(t *testing.T) {
+		response := Response{
+			Rcode: dns.RcodeSuccess,
+			Answer: []dns.RR{
+				&dns.A{Hdr: dns.RR_Header{Ttl: 600}},
+				&dns.A{Hdr: dns.RR_Header{Ttl: 60}},
+				&dns.A{Hdr: dns.RR_Header{Ttl: 300}},
+			},
+		}
+		if ttl := responseTTL(response); ttl != 60 {
+			t.Fatalf("ttl = %d, want 60", ttl)
+		}
+	})
+
+	t.Run("positive answer with no RRs falls back to the configured expiry", func(t *testing.T) {
+		response := Response{Rcode: dns.RcodeSuccess}
+		if ttl := responseTTL(response); ttl != uint32(ExpiryTimeInSeconds) {
+			t.Fatalf("ttl = %d, want %d", ttl, ExpiryTimeInSeconds)
+		}
+	})
+
+	t.Run("NXDOMAIN uses the SOA MINIMUM field", func(t *testing.T) {
+		response := Response{
+			Rcode:     dns.RcodeNameError,
+			Authority: []dns.RR{&dns.SOA{Minttl: 120}},
+		}
+		if ttl := responseTTL(response); ttl != 120 {
+			t.Fatalf("ttl = %d, want 120", ttl)
+		}
+	})
+
+	t.Run("NXDOMAIN with no SOA falls back to the configured expiry", func(t *testing.T) {
+		response := Response{Rcode: dns.RcodeNameError}
+		if ttl := responseTTL(response); ttl != uint32(ExpiryTimeInSeconds) {
+			t.Fatalf("ttl = %d, want %d", ttl, ExpiryTimeInSeconds)
+		}
+	})
+
+	t.Run("a transient failure is never cached", func(t *testing.T) {
+		response := Response{Rcode: dns.RcodeServerFailure}
+		if ttl := responseTTL(response); ttl != 0 {
+			t.Fatalf("ttl = %d, want 0", ttl)
+		}
+	})
+}
+
+// startTestDNSServer runs a UDP DNS server on an OS-assigned port for the
+// lifetime of the test, returning its address for use as a forwarder.
+func startTestDNSServer(t *testing.T, handler dns.HandlerFunc) string {
+	t.Helper()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatalf("ListenPacket: %v", err)
+	}
+
+	server := &dns.Server{PacketConn: conn, Handler: handler}
+	go server.ActivateAndServe()
+	t.Cleanup(func() { server.Shutdown() })
+
+	return conn.LocalAddr().String()
+}
+
+func TestForwarderResolver_PrefersAuthoritativeOverNonAuthoritative(t *testing.T) {
+	servfail := startTestDNSServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetRcode(r, dns.RcodeServerFailure)
+		w.WriteMsg(m)
+	}))
+
+	noerror := startTestDNSServer(t, dns.HandlerFunc(func(w dns.ResponseWriter, r *dns.Msg) {
+		m := new(dns.Msg)
+		m.SetReply(r)
+		rr, err := dns.NewRR(r.Question[0].Name + " 300 IN A 127.0.0.1")
+		if err != nil {
+			t.Fatalf("NewRR: %v", err)
+		}
+		m.Answer = append(m.Answer, rr)
+		w.WriteMsg(m)
+	}))
+
+	resolver := NewForwarderResolver([]string{servfail, noerror}, 2*time.Second)
+
+	response, err := resolver.Resolve(dns.Question{Name: "host.example.", Qtype: dns.TypeA, Qclass: dns.ClassINET})
+	if err != nil {
+		t.Fatalf("Resolve: %v", err)
+	}
+	if response.Rcode != dns.RcodeSuccess {
+		t.Fatalf("rcode = %s, want NOERROR", dns.RcodeToString[response.Rcode])
+	}
+	if response.Upstream != noerror {
+		t.Fatalf("upstream = %q, want the NOERROR forwarder %q", response.Upstream, noerror)
+	}
+}
+
+func TestProcessQuery_MalformedBodyStillReturnsAWellFormedFormErr(t *testing.T) {
+	query := new(dns.Msg)
+	query.SetQuestion("example.com.", dns.TypeA)
+	query.Id = 0x1234
+	query.RecursionDesired = true
+
+	packed, err := query.Pack()
+	if err != nil {
+		t.Fatalf("Pack: %v", err)
+	}
+
+	// Truncate partway into the question, leaving the 12-byte header
+	// intact but the body malformed -- Unpack parses the header (so
+	// query.Id etc. are populated) before it fails on the truncated
+	// question.
+	truncated := packed[:16]
+
+	responseBytes := processQuery(truncated, dns.MaxMsgSize, "udp", "127.0.0.1:0")
+	if responseBytes == nil {
+		t.Fatalf("processQuery returned nil")
+	}
+
+	var response dns.Msg
+	if err := response.Unpack(responseBytes); err != nil {
+		t.Fatalf("Unpack response: %v", err)
+	}
+
+	if response.Id != query.Id {
+		t.Errorf("Id = %d, want %d (echoed from the malformed request's header)", response.Id, query.Id)
+	}
+	if !response.Response {
+		t.Errorf("Response (QR bit) = false, want true")
+	}
+	if response.Rcode != dns.RcodeFormatError {
+		t.Errorf("Rcode = %s, want FORMERR", dns.RcodeToString[response.Rcode])
+	}
+}
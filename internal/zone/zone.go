@@ -0,0 +1,397 @@
+// Package zone defines the structured Redis schema humandns53 uses to
+// store DNS resource records and the helpers to read and write it.
+//
+// Each RRset lives under a key "dns:{name}:{type}" (name lowercased and
+// fully qualified, type the RR type's mnemonic, e.g. "A" or "MX") holding
+// a JSON array of that type's record shape. Both the server and the
+// humandns53-cli tool read and write this schema, so the encoding lives
+// here rather than in either of them.
+package zone
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net"
+	"reflect"
+	"strings"
+
+	"github.com/miekg/dns"
+)
+
+// KeyPrefix namespaces every structured zone key in Redis.
+const KeyPrefix = "dns"
+
+// SupportedTypes is the set of RR types the structured schema knows how
+// to store and decode.
+var SupportedTypes = map[uint16]bool{
+	dns.TypeA:     true,
+	dns.TypeAAAA:  true,
+	dns.TypeCNAME: true,
+	dns.TypeMX:    true,
+	dns.TypeTXT:   true,
+	dns.TypeSRV:   true,
+	dns.TypeNS:    true,
+	dns.TypeSOA:   true,
+	dns.TypePTR:   true,
+}
+
+// Key returns the Redis key holding the RRset of type rrType at name.
+func Key(name, rrType string) string {
+	return KeyPrefix + ":" + strings.ToLower(dns.Fqdn(name)) + ":" + strings.ToUpper(rrType)
+}
+
+// KeyForType is Key, taking the RR type as its numeric dns.Type* constant.
+func KeyForType(name string, rrType uint16) string {
+	return Key(name, dns.TypeToString[rrType])
+}
+
+// ARecord is the shape stored for one A or AAAA record.
+type ARecord struct {
+	IP  string `json:"ip"`
+	TTL uint32 `json:"ttl,omitempty"`
+}
+
+// CNAMERecord is the shape stored for one CNAME record.
+type CNAMERecord struct {
+	Target string `json:"target"`
+	TTL    uint32 `json:"ttl,omitempty"`
+}
+
+// MXRecord is the shape stored for one MX record.
+type MXRecord struct {
+	Target   string `json:"target"`
+	Priority uint16 `json:"priority"`
+	TTL      uint32 `json:"ttl,omitempty"`
+}
+
+// TXTRecord is the shape stored for one TXT record. Chunks holds its
+// character-strings (RFC 1035 §3.3.14) in order.
+type TXTRecord struct {
+	Chunks []string `json:"chunks"`
+	TTL    uint32   `json:"ttl,omitempty"`
+}
+
+// SRVRecord is the shape stored for one SRV record (RFC 2782).
+type SRVRecord struct {
+	Priority uint16 `json:"priority"`
+	Weight   uint16 `json:"weight"`
+	Port     uint16 `json:"port"`
+	Target   string `json:"target"`
+	TTL      uint32 `json:"ttl,omitempty"`
+}
+
+// NSRecord is the shape stored for one NS record.
+type NSRecord struct {
+	NS  string `json:"ns"`
+	TTL uint32 `json:"ttl,omitempty"`
+}
+
+// PTRRecord is the shape stored for one PTR record.
+type PTRRecord struct {
+	Target string `json:"target"`
+	TTL    uint32 `json:"ttl,omitempty"`
+}
+
+// SOARecord is the shape stored for one SOA record.
+type SOARecord struct {
+	NS      string `json:"ns"`
+	Mbox    string `json:"mbox"`
+	Serial  uint32 `json:"serial"`
+	Refresh uint32 `json:"refresh"`
+	Retry   uint32 `json:"retry"`
+	Expire  uint32 `json:"expire"`
+	Minttl  uint32 `json:"minttl"`
+	TTL     uint32 `json:"ttl,omitempty"`
+}
+
+// DecodeRRSet unmarshals the JSON array stored under a dns:{name}:{type}
+// key into the matching []dns.RR, encoding each record's RDATA per
+// RFC 1035 §3.3 (compression of the resulting names happens for free when
+// the message is packed). defaultTTL is used for any record that doesn't
+// specify its own "ttl".
+func DecodeRRSet(name string, rrType uint16, raw string, defaultTTL uint32) ([]dns.RR, error) {
+	header := func(ttl uint32) dns.RR_Header {
+		if ttl == 0 {
+			ttl = defaultTTL
+		}
+		return dns.RR_Header{Name: dns.Fqdn(name), Rrtype: rrType, Class: dns.ClassINET, Ttl: ttl}
+	}
+
+	switch rrType {
+	case dns.TypeA:
+		var records []ARecord
+		if err := json.Unmarshal([]byte(raw), &records); err != nil {
+			return nil, err
+		}
+		rrs := make([]dns.RR, 0, len(records))
+		for _, r := range records {
+			ip := net.ParseIP(r.IP)
+			if ip == nil || ip.To4() == nil {
+				return nil, fmt.Errorf("invalid A address %q", r.IP)
+			}
+			rrs = append(rrs, &dns.A{Hdr: header(r.TTL), A: ip.To4()})
+		}
+		return rrs, nil
+
+	case dns.TypeAAAA:
+		var records []ARecord
+		if err := json.Unmarshal([]byte(raw), &records); err != nil {
+			return nil, err
+		}
+		rrs := make([]dns.RR, 0, len(records))
+		for _, r := range records {
+			ip := net.ParseIP(r.IP)
+			if ip == nil {
+				return nil, fmt.Errorf("invalid AAAA address %q", r.IP)
+			}
+			rrs = append(rrs, &dns.AAAA{Hdr: header(r.TTL), AAAA: ip})
+		}
+		return rrs, nil
+
+	case dns.TypeCNAME:
+		var records []CNAMERecord
+		if err := json.Unmarshal([]byte(raw), &records); err != nil {
+			return nil, err
+		}
+		rrs := make([]dns.RR, 0, len(records))
+		for _, r := range records {
+			rrs = append(rrs, &dns.CNAME{Hdr: header(r.TTL), Target: dns.Fqdn(r.Target)})
+		}
+		return rrs, nil
+
+	case dns.TypeMX:
+		var records []MXRecord
+		if err := json.Unmarshal([]byte(raw), &records); err != nil {
+			return nil, err
+		}
+		rrs := make([]dns.RR, 0, len(records))
+		for _, r := range records {
+			rrs = append(rrs, &dns.MX{Hdr: header(r.TTL), Preference: r.Priority, Mx: dns.Fqdn(r.Target)})
+		}
+		return rrs, nil
+
+	case dns.TypeTXT:
+		var records []TXTRecord
+		if err := json.Unmarshal([]byte(raw), &records); err != nil {
+			return nil, err
+		}
+		rrs := make([]dns.RR, 0, len(records))
+		for _, r := range records {
+			rrs = append(rrs, &dns.TXT{Hdr: header(r.TTL), Txt: r.Chunks})
+		}
+		return rrs, nil
+
+	case dns.TypeSRV:
+		var records []SRVRecord
+		if err := json.Unmarshal([]byte(raw), &records); err != nil {
+			return nil, err
+		}
+		rrs := make([]dns.RR, 0, len(records))
+		for _, r := range records {
+			rrs = append(rrs, &dns.SRV{Hdr: header(r.TTL), Priority: r.Priority, Weight: r.Weight, Port: r.Port, Target: dns.Fqdn(r.Target)})
+		}
+		return rrs, nil
+
+	case dns.TypeNS:
+		var records []NSRecord
+		if err := json.Unmarshal([]byte(raw), &records); err != nil {
+			return nil, err
+		}
+		rrs := make([]dns.RR, 0, len(records))
+		for _, r := range records {
+			rrs = append(rrs, &dns.NS{Hdr: header(r.TTL), Ns: dns.Fqdn(r.NS)})
+		}
+		return rrs, nil
+
+	case dns.TypePTR:
+		var records []PTRRecord
+		if err := json.Unmarshal([]byte(raw), &records); err != nil {
+			return nil, err
+		}
+		rrs := make([]dns.RR, 0, len(records))
+		for _, r := range records {
+			rrs = append(rrs, &dns.PTR{Hdr: header(r.TTL), Ptr: dns.Fqdn(r.Target)})
+		}
+		return rrs, nil
+
+	case dns.TypeSOA:
+		var records []SOARecord
+		if err := json.Unmarshal([]byte(raw), &records); err != nil {
+			return nil, err
+		}
+		rrs := make([]dns.RR, 0, len(records))
+		for _, r := range records {
+			rrs = append(rrs, &dns.SOA{
+				Hdr:     header(r.TTL),
+				Ns:      dns.Fqdn(r.NS),
+				Mbox:    dns.Fqdn(r.Mbox),
+				Serial:  r.Serial,
+				Refresh: r.Refresh,
+				Retry:   r.Retry,
+				Expire:  r.Expire,
+				Minttl:  r.Minttl,
+			})
+		}
+		return rrs, nil
+	}
+
+	return nil, fmt.Errorf("unsupported record type %s", dns.TypeToString[rrType])
+}
+
+// PTRZoneName returns the in-addr.arpa/ip6.arpa owner name PTR records
+// for ip live under (RFC 1035 §3.5).
+func PTRZoneName(ip net.IP) (string, error) {
+	return dns.ReverseAddr(ip.String())
+}
+
+// RecordFor converts rr into the record value this package's schema
+// stores for its type (the shape DecodeRRSet decodes back out of Redis).
+func RecordFor(rr dns.RR) (interface{}, error) {
+	ttl := rr.Header().Ttl
+
+	switch rr := rr.(type) {
+	case *dns.A:
+		return ARecord{IP: rr.A.String(), TTL: ttl}, nil
+	case *dns.AAAA:
+		return ARecord{IP: rr.AAAA.String(), TTL: ttl}, nil
+	case *dns.CNAME:
+		return CNAMERecord{Target: rr.Target, TTL: ttl}, nil
+	case *dns.MX:
+		return MXRecord{Target: rr.Mx, Priority: rr.Preference, TTL: ttl}, nil
+	case *dns.TXT:
+		return TXTRecord{Chunks: rr.Txt, TTL: ttl}, nil
+	case *dns.SRV:
+		return SRVRecord{Priority: rr.Priority, Weight: rr.Weight, Port: rr.Port, Target: rr.Target, TTL: ttl}, nil
+	case *dns.NS:
+		return NSRecord{NS: rr.Ns, TTL: ttl}, nil
+	case *dns.PTR:
+		return PTRRecord{Target: rr.Ptr, TTL: ttl}, nil
+	case *dns.SOA:
+		return SOARecord{
+			NS: rr.Ns, Mbox: rr.Mbox, Serial: rr.Serial,
+			Refresh: rr.Refresh, Retry: rr.Retry, Expire: rr.Expire, Minttl: rr.Minttl,
+			TTL: ttl,
+		}, nil
+	}
+
+	return nil, fmt.Errorf("unsupported record type %s", dns.TypeToString[rr.Header().Rrtype])
+}
+
+// AppendRecord appends record's JSON encoding onto the RRset JSON array
+// stored in raw (raw may be "", an empty RRset), returning the updated
+// RRset's JSON encoding. If an identical record (same fields other than
+// TTL) is already present, it's left as-is and record is not appended
+// again, since RFC 2136 ADD is defined to be a no-op in that case rather
+// than accumulating duplicate RRs.
+func AppendRecord(raw string, record interface{}) (string, error) {
+	var records []json.RawMessage
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &records); err != nil {
+			return "", err
+		}
+	}
+
+	target, err := identity(record)
+	if err != nil {
+		return "", err
+	}
+
+	for _, r := range records {
+		storedID, err := identityOf(r, record)
+		if err != nil {
+			return "", err
+		}
+
+		if bytes.Equal(storedID, target) {
+			return raw, nil
+		}
+	}
+
+	encoded, err := json.Marshal(record)
+	if err != nil {
+		return "", err
+	}
+
+	records = append(records, encoded)
+
+	updated, err := json.Marshal(records)
+	if err != nil {
+		return "", err
+	}
+
+	return string(updated), nil
+}
+
+// identity encodes record with its TTL zeroed out, so two records that
+// differ only in TTL compare equal. This matters for RemoveRecord: RFC 2136
+// §2.5.4 requires a DELETE RR to carry TTL 0 on the wire, while the stored
+// record it's deleting almost certainly has a real TTL, so comparing raw
+// encodings would never match.
+func identity(record interface{}) ([]byte, error) {
+	v := reflect.ValueOf(record)
+	ttl := v.FieldByName("TTL")
+	if !ttl.IsValid() || ttl.Kind() != reflect.Uint32 {
+		return nil, fmt.Errorf("record type %T has no TTL field", record)
+	}
+
+	stripped := reflect.New(v.Type()).Elem()
+	stripped.Set(v)
+	stripped.FieldByName("TTL").SetUint(0)
+
+	return json.Marshal(stripped.Interface())
+}
+
+// identityOf decodes raw (one stored RRset entry) into sample's concrete
+// type and returns its identity, so it can be compared against another
+// record of the same type without caring about their TTLs.
+func identityOf(raw json.RawMessage, sample interface{}) ([]byte, error) {
+	decoded := reflect.New(reflect.TypeOf(sample))
+	if err := json.Unmarshal(raw, decoded.Interface()); err != nil {
+		return nil, err
+	}
+
+	return identity(decoded.Elem().Interface())
+}
+
+// RemoveRecord removes every entry in the RRset JSON array stored in raw
+// that identifies the same record as record (same fields other than TTL,
+// per RFC 2136 §2.5.4), returning the updated RRset's JSON encoding and
+// whether it is now empty (in which case the caller should delete the key
+// rather than storing an empty array).
+func RemoveRecord(raw string, record interface{}) (updated string, empty bool, err error) {
+	var records []json.RawMessage
+	if raw != "" {
+		if err := json.Unmarshal([]byte(raw), &records); err != nil {
+			return "", false, err
+		}
+	}
+
+	target, err := identity(record)
+	if err != nil {
+		return "", false, err
+	}
+
+	kept := records[:0]
+	for _, r := range records {
+		storedID, err := identityOf(r, record)
+		if err != nil {
+			return "", false, err
+		}
+
+		if !bytes.Equal(storedID, target) {
+			kept = append(kept, r)
+		}
+	}
+
+	if len(kept) == 0 {
+		return "", true, nil
+	}
+
+	result, err := json.Marshal(kept)
+	if err != nil {
+		return "", false, err
+	}
+
+	return string(result), false, nil
+}
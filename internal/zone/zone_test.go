@@ -0,0 +1,159 @@
+package zone
+
+import (
+	"net"
+	"testing"
+
+	"github.com/miekg/dns"
+)
+
+func TestAppendRecord_DedupesIdenticalRecordIgnoringTTL(t *testing.T) {
+	raw, err := AppendRecord("", ARecord{IP: "10.0.0.1", TTL: 300})
+	if err != nil {
+		t.Fatalf("AppendRecord: %v", err)
+	}
+
+	// RFC 2136 ADD of a record that's already present (same fields other
+	// than TTL) is a no-op, not a duplicate.
+	raw, err = AppendRecord(raw, ARecord{IP: "10.0.0.1", TTL: 600})
+	if err != nil {
+		t.Fatalf("AppendRecord: %v", err)
+	}
+
+	rrs, err := DecodeRRSet("host.example.", dns.TypeA, raw, 0)
+	if err != nil {
+		t.Fatalf("DecodeRRSet: %v", err)
+	}
+	if len(rrs) != 1 {
+		t.Fatalf("got %d records, want 1", len(rrs))
+	}
+
+	raw, err = AppendRecord(raw, ARecord{IP: "10.0.0.2", TTL: 300})
+	if err != nil {
+		t.Fatalf("AppendRecord: %v", err)
+	}
+
+	rrs, err = DecodeRRSet("host.example.", dns.TypeA, raw, 0)
+	if err != nil {
+		t.Fatalf("DecodeRRSet: %v", err)
+	}
+	if len(rrs) != 2 {
+		t.Fatalf("got %d records, want 2", len(rrs))
+	}
+}
+
+func TestRemoveRecord_MatchesByIdentityIgnoringTTL(t *testing.T) {
+	raw, err := AppendRecord("", ARecord{IP: "10.0.0.1", TTL: 300})
+	if err != nil {
+		t.Fatalf("AppendRecord: %v", err)
+	}
+	raw, err = AppendRecord(raw, ARecord{IP: "10.0.0.2", TTL: 300})
+	if err != nil {
+		t.Fatalf("AppendRecord: %v", err)
+	}
+
+	// RFC 2136 §2.5.4 requires a DELETE RR to carry TTL 0 on the wire, so
+	// RemoveRecord must still match the stored record despite the TTLs
+	// differing.
+	updated, empty, err := RemoveRecord(raw, ARecord{IP: "10.0.0.1", TTL: 0})
+	if err != nil {
+		t.Fatalf("RemoveRecord: %v", err)
+	}
+	if empty {
+		t.Fatalf("unexpectedly empty after removing one of two records")
+	}
+
+	rrs, err := DecodeRRSet("host.example.", dns.TypeA, updated, 0)
+	if err != nil {
+		t.Fatalf("DecodeRRSet: %v", err)
+	}
+	if len(rrs) != 1 {
+		t.Fatalf("got %d records, want 1", len(rrs))
+	}
+
+	_, empty, err = RemoveRecord(updated, ARecord{IP: "10.0.0.2", TTL: 0})
+	if err != nil {
+		t.Fatalf("RemoveRecord: %v", err)
+	}
+	if !empty {
+		t.Fatalf("expected empty after removing the last record")
+	}
+}
+
+func TestDecodeRRSet(t *testing.T) {
+	t.Run("MX falls back to the default TTL when the record has none", func(t *testing.T) {
+		rrs, err := DecodeRRSet("mail.example.", dns.TypeMX, `[{"target":"mx1.example.","priority":10}]`, 1800)
+		if err != nil {
+			t.Fatalf("DecodeRRSet: %v", err)
+		}
+		if len(rrs) != 1 {
+			t.Fatalf("got %d RRs, want 1", len(rrs))
+		}
+
+		mx, ok := rrs[0].(*dns.MX)
+		if !ok {
+			t.Fatalf("rrs[0] is %T, want *dns.MX", rrs[0])
+		}
+		if mx.Mx != "mx1.example." || mx.Preference != 10 {
+			t.Fatalf("mx = %+v, want Mx mx1.example. Preference 10", mx)
+		}
+		if mx.Hdr.Ttl != 1800 {
+			t.Fatalf("ttl = %d, want the default 1800", mx.Hdr.Ttl)
+		}
+	})
+
+	t.Run("SRV decodes every field", func(t *testing.T) {
+		rrs, err := DecodeRRSet("_sip._tcp.example.", dns.TypeSRV, `[{"priority":10,"weight":20,"port":5060,"target":"sip.example.","ttl":60}]`, 1800)
+		if err != nil {
+			t.Fatalf("DecodeRRSet: %v", err)
+		}
+
+		srv, ok := rrs[0].(*dns.SRV)
+		if !ok {
+			t.Fatalf("rrs[0] is %T, want *dns.SRV", rrs[0])
+		}
+		if srv.Priority != 10 || srv.Weight != 20 || srv.Port != 5060 || srv.Target != "sip.example." {
+			t.Fatalf("srv = %+v, unexpected field(s)", srv)
+		}
+		if srv.Hdr.Ttl != 60 {
+			t.Fatalf("ttl = %d, want the record's own 60", srv.Hdr.Ttl)
+		}
+	})
+
+	t.Run("an invalid A address is an error", func(t *testing.T) {
+		if _, err := DecodeRRSet("host.example.", dns.TypeA, `[{"ip":"not-an-ip"}]`, 1800); err == nil {
+			t.Fatalf("DecodeRRSet: expected an error for an invalid IP, got none")
+		}
+	})
+
+	t.Run("an unsupported RR type is an error", func(t *testing.T) {
+		if _, err := DecodeRRSet("host.example.", dns.TypeCAA, `[]`, 1800); err == nil {
+			t.Fatalf("DecodeRRSet: expected an error for an unsupported type, got none")
+		}
+	})
+}
+
+func TestRecordFor_RoundTripsThroughDecodeRRSet(t *testing.T) {
+	a := &dns.A{Hdr: dns.RR_Header{Ttl: 300}, A: net.ParseIP("10.0.0.1").To4()}
+
+	record, err := RecordFor(a)
+	if err != nil {
+		t.Fatalf("RecordFor: %v", err)
+	}
+
+	raw, err := AppendRecord("", record)
+	if err != nil {
+		t.Fatalf("AppendRecord: %v", err)
+	}
+
+	rrs, err := DecodeRRSet("host.example.", dns.TypeA, raw, 0)
+	if err != nil {
+		t.Fatalf("DecodeRRSet: %v", err)
+	}
+	if len(rrs) != 1 {
+		t.Fatalf("got %d RRs, want 1", len(rrs))
+	}
+	if got := rrs[0].(*dns.A).A.String(); got != "10.0.0.1" {
+		t.Fatalf("A = %q, want 10.0.0.1", got)
+	}
+}
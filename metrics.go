@@ -0,0 +1,59 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"os"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/promauto"
+	"github.com/prometheus/client_golang/prometheus/promhttp"
+)
+
+var (
+	requestsTotal = promauto.NewCounterVec(prometheus.CounterOpts{
+		Name: "dns_requests_total",
+		Help: "Total DNS requests processed, labeled by transport, query type and response code.",
+	}, []string{"proto", "qtype", "rcode"})
+
+	requestDuration = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dns_request_duration_seconds",
+		Help:    "Time to process a single DNS request, labeled by transport.",
+		Buckets: prometheus.DefBuckets,
+	}, []string{"proto"})
+
+	responseSizeBytes = promauto.NewHistogramVec(prometheus.HistogramOpts{
+		Name:    "dns_response_size_bytes",
+		Help:    "Size of packed DNS responses in bytes, labeled by transport.",
+		Buckets: prometheus.ExponentialBuckets(64, 2, 10),
+	}, []string{"proto"})
+
+	cacheHitsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dns_cache_hits_total",
+		Help: "Resolver cache hits.",
+	})
+
+	cacheMissesTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "dns_cache_misses_total",
+		Help: "Resolver cache misses.",
+	})
+
+	redisErrorsTotal = promauto.NewCounter(prometheus.CounterOpts{
+		Name: "redis_errors_total",
+		Help: "Errors returned by the backing Redis client (cache misses don't count).",
+	})
+)
+
+// serveMetrics exposes the registered Prometheus collectors on /metrics at
+// addr. It's only started when -metrics-addr is set.
+func serveMetrics(addr string) {
+	mux := http.NewServeMux()
+	mux.Handle("/metrics", promhttp.Handler())
+
+	log.Println("Listening (metrics) at: ", addr)
+
+	if err := http.ListenAndServe(addr, mux); err != nil {
+		log.Println("Error serving metrics: ", err.Error())
+		os.Exit(1)
+	}
+}